@@ -0,0 +1,127 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec marshals and unmarshals Go values to and from the bytes published on, or received from, an
+// MQTT topic. It lets callers work with typed values instead of hand-marshaling []byte for every call.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes payloads as JSON. It's the default codec used by PublishEventTyped and
+// RegisterConfigHandlerTyped when ThingOptions.DefaultCodec isn't set.
+type JSONCodec struct{}
+
+// Marshal implements Codec.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal implements Codec.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// CBORCodec encodes payloads as CBOR, a good fit for constrained devices that need a compact binary
+// encoding without a schema compiler.
+type CBORCodec struct{}
+
+// Marshal implements Codec.
+func (CBORCodec) Marshal(v interface{}) ([]byte, error) { return cbor.Marshal(v) }
+
+// Unmarshal implements Codec.
+func (CBORCodec) Unmarshal(data []byte, v interface{}) error { return cbor.Unmarshal(data, v) }
+
+// ProtobufCodec encodes payloads as protocol buffers. v must implement proto.Message.
+type ProtobufCodec struct{}
+
+// Marshal implements Codec.
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("iot: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(message)
+}
+
+// Unmarshal implements Codec.
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("iot: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// errNotATypedThing is returned by the Typed helpers when given a Thing that wasn't created with New.
+var errNotATypedThing = errors.New("iot: typed helpers require a Thing created with New")
+
+func codecFor(th Thing, override Codec) (Codec, error) {
+	if override != nil {
+		return override, nil
+	}
+	t, ok := th.(*thing)
+	if !ok {
+		return nil, errNotATypedThing
+	}
+	if t.options.DefaultCodec != nil {
+		return t.options.DefaultCodec, nil
+	}
+	return JSONCodec{}, nil
+}
+
+// PublishEventTyped marshals v with the thing's DefaultCodec and publishes it as a telemetry event,
+// optionally to a subfolder of /events.
+func PublishEventTyped[T any](ctx context.Context, th Thing, v T, subfolder ...string) error {
+	return PublishEventTypedWithCodec(ctx, th, nil, v, subfolder...)
+}
+
+// PublishEventTypedWithCodec is like PublishEventTyped, but overrides the codec used for this call
+// instead of using the thing's DefaultCodec.
+func PublishEventTypedWithCodec[T any](ctx context.Context, th Thing, codec Codec, v T, subfolder ...string) error {
+	c, err := codecFor(th, codec)
+	if err != nil {
+		return err
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return th.PublishEvent(ctx, data, subfolder...)
+}
+
+// RegisterConfigHandlerTyped installs a ConfigHandler that decodes incoming configuration payloads
+// with the thing's DefaultCodec before invoking handler, replacing any ConfigHandler set on
+// ThingOptions.
+func RegisterConfigHandlerTyped[T any](th Thing, handler func(T)) error {
+	t, ok := th.(*thing)
+	if !ok {
+		return errNotATypedThing
+	}
+
+	codec := t.options.DefaultCodec
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	t.setConfigHandler(func(_ Thing, payload []byte) {
+		var v T
+		if err := codec.Unmarshal(payload, &v); err != nil {
+			if t.options.ErrorLogger != nil {
+				t.options.ErrorLogger(fmt.Sprintf("iot: couldn't decode typed config: %v", err))
+			}
+			return
+		}
+		handler(v)
+	})
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vaelen/iot"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type reading struct {
+	Sensor      string  `json:"sensor"`
+	Temperature float64 `json:"temperature"`
+}
+
+func newTypedThing(t *testing.T, codec iot.Codec) (iot.Thing, *iot.MockMQTTClient) {
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(thing iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(thing, o)
+		return mockClient
+	}
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(TestID, credentials)
+	options.DefaultCodec = codec
+	thing := iot.New(options)
+
+	ctx := context.Background()
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	t.Cleanup(func() { thing.Disconnect(ctx) })
+
+	return thing, mockClient
+}
+
+func TestPublishEventTypedJSON(t *testing.T) {
+	ctx := context.Background()
+	thing, mockClient := newTypedThing(t, iot.JSONCodec{})
+
+	sent := reading{Sensor: "temp-1", Temperature: 21.5}
+	if err := iot.PublishEventTyped(ctx, thing, sent); err != nil {
+		t.Fatalf("Couldn't publish typed event: %v", err)
+	}
+
+	l, ok := mockClient.Messages[EventsTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Typed event wasn't published. Topic: %v", EventsTopic)
+	}
+
+	var received reading
+	if err := (iot.JSONCodec{}).Unmarshal(l[0].([]byte), &received); err != nil {
+		t.Fatalf("Couldn't decode published payload: %v", err)
+	}
+	if received != sent {
+		t.Fatalf("Wrong value round-tripped: %+v", received)
+	}
+}
+
+func TestPublishEventTypedCBOR(t *testing.T) {
+	ctx := context.Background()
+	thing, mockClient := newTypedThing(t, iot.CBORCodec{})
+
+	sent := reading{Sensor: "temp-2", Temperature: 19.25}
+	if err := iot.PublishEventTyped(ctx, thing, sent); err != nil {
+		t.Fatalf("Couldn't publish typed event: %v", err)
+	}
+
+	l, ok := mockClient.Messages[EventsTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Typed event wasn't published. Topic: %v", EventsTopic)
+	}
+
+	var received reading
+	if err := (iot.CBORCodec{}).Unmarshal(l[0].([]byte), &received); err != nil {
+		t.Fatalf("Couldn't decode published payload: %v", err)
+	}
+	if received != sent {
+		t.Fatalf("Wrong value round-tripped: %+v", received)
+	}
+}
+
+func TestPublishEventTypedProtobuf(t *testing.T) {
+	ctx := context.Background()
+	thing, mockClient := newTypedThing(t, iot.ProtobufCodec{})
+
+	sent := wrapperspb.String("sensor reading")
+	if err := iot.PublishEventTypedWithCodec(ctx, thing, iot.ProtobufCodec{}, sent); err != nil {
+		t.Fatalf("Couldn't publish typed event: %v", err)
+	}
+
+	l, ok := mockClient.Messages[EventsTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Typed event wasn't published. Topic: %v", EventsTopic)
+	}
+
+	received := &wrapperspb.StringValue{}
+	if err := (iot.ProtobufCodec{}).Unmarshal(l[0].([]byte), received); err != nil {
+		t.Fatalf("Couldn't decode published payload: %v", err)
+	}
+	if received.Value != sent.Value {
+		t.Fatalf("Wrong value round-tripped: %v", received.Value)
+	}
+}
+
+func TestRegisterConfigHandlerTyped(t *testing.T) {
+	thing, mockClient := newTypedThing(t, iot.JSONCodec{})
+
+	var received reading
+	if err := iot.RegisterConfigHandlerTyped(thing, func(r reading) {
+		received = r
+	}); err != nil {
+		t.Fatalf("Couldn't register typed config handler: %v", err)
+	}
+
+	sent := reading{Sensor: "temp-3", Temperature: 18.0}
+	data, err := (iot.JSONCodec{}).Marshal(sent)
+	if err != nil {
+		t.Fatalf("Couldn't encode config: %v", err)
+	}
+
+	mockClient.Receive(ConfigTopic, data)
+
+	if received != sent {
+		t.Fatalf("Wrong value decoded for config handler: %+v", received)
+	}
+}
+
+func TestRegisterConfigHandlerTypedConcurrentWithReceive(t *testing.T) {
+	thing, mockClient := newTypedThing(t, iot.JSONCodec{})
+
+	data, err := (iot.JSONCodec{}).Marshal(reading{Sensor: "temp-4", Temperature: 12.0})
+	if err != nil {
+		t.Fatalf("Couldn't encode config: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mockClient.Receive(ConfigTopic, data)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := iot.RegisterConfigHandlerTyped(thing, func(r reading) {}); err != nil {
+			t.Fatalf("Couldn't register typed config handler: %v", err)
+		}
+	}
+
+	<-done
+}
@@ -0,0 +1,70 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Credentials holds the private key used to sign authentication tokens sent to Google Cloud IoT Core.
+type Credentials struct {
+	PrivateKey *rsa.PrivateKey
+}
+
+// LoadCredentials loads the certificate and private key used to authenticate with Google Cloud IoT Core.
+// The certificate isn't used to sign tokens, but loading it up front lets callers fail fast if the
+// key pair on disk doesn't match.
+func LoadCredentials(certificatePath string, privateKeyPath string) (*Credentials, error) {
+	certPEM, err := ioutil.ReadFile(certificatePath)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(certPEM); block == nil {
+		return nil, errors.New("iot: couldn't decode certificate PEM block")
+	}
+
+	keyPEM, err := ioutil.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credentials{PrivateKey: privateKey}, nil
+}
+
+// CredentialsProvider returns the username and password to use when connecting to the MQTT server.
+// Google Cloud IoT Core ignores the username and expects the password to be a signed JWT.
+type CredentialsProvider func() (username string, password string)
+
+// NewCredentialsProvider returns a CredentialsProvider that signs a fresh JWT, valid for tokenExpiration,
+// every time it is called.
+func NewCredentialsProvider(id *ID, credentials *Credentials, tokenExpiration time.Duration) CredentialsProvider {
+	return func() (string, string) {
+		token, err := createAuthToken(id, credentials, tokenExpiration)
+		if err != nil {
+			return "", ""
+		}
+		return "unused", token
+	}
+}
+
+func createAuthToken(id *ID, credentials *Credentials, tokenExpiration time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenExpiration).Unix(),
+		Audience:  id.ProjectID,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	return token.SignedString(credentials.PrivateKey)
+}
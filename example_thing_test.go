@@ -4,6 +4,7 @@
 package iot_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 
@@ -28,29 +29,36 @@ func ExampleThing() {
 		panic("Couldn't create temp directory")
 	}
 
+	messageStore, err := iot.NewFileStore(tmpDir)
+	if err != nil {
+		panic("Couldn't create message store")
+	}
+
 	options := iot.DefaultOptions(id, credentials)
 	options.DebugLogger = func(a ...interface{}) { fmt.Println(a...) }
 	options.InfoLogger = func(a ...interface{}) { fmt.Println(a...) }
 	options.ErrorLogger = func(a ...interface{}) { fmt.Println(a...) }
-	options.QueueDirectory = tmpDir
+	options.MessageStore = messageStore
+	ctx := context.Background()
+
 	options.ConfigHandler = func(thing iot.Thing, config []byte) {
 		// Do something here to process the updated config and create an updated state string
 		state := []byte("ok")
-		thing.PublishState(state)
+		thing.PublishState(ctx, state)
 	}
 
 	thing := iot.New(options)
 
-	err = thing.Connect("ssl://mqtt.googleapis.com:443")
+	err = thing.Connect(ctx, "ssl://mqtt.googleapis.com:443")
 	if err != nil {
 		panic("Couldn't connect to server")
 	}
-	defer thing.Disconnect()
+	defer thing.Disconnect(ctx)
 
 	// This publishes to /events
-	thing.PublishEvent([]byte("Top level telemetry event"))
+	thing.PublishEvent(ctx, []byte("Top level telemetry event"))
 	// This publishes to /events/a
-	thing.PublishEvent([]byte("Sub folder telemetry event"), "a")
+	thing.PublishEvent(ctx, []byte("Sub folder telemetry event"), "a")
 	// This publishes to /events/a/b
-	thing.PublishEvent([]byte("Sub folder telemetry event"), "a", "b")
-}
\ No newline at end of file
+	thing.PublishEvent(ctx, []byte("Sub folder telemetry event"), "a", "b")
+}
@@ -0,0 +1,174 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// AttachQOS is the QoS level used for the attach and detach handshake messages, as recommended by
+// Google Cloud IoT Core.
+const AttachQOS = 1
+
+// ErrNotAGateway is returned by the gateway methods when the Thing's ID doesn't have IsGateway set.
+var ErrNotAGateway = errors.New("iot: thing is not configured as a gateway")
+
+// ErrDeviceNotAttached is returned by the *As methods when called for a device that hasn't been
+// attached with AttachDevice.
+var ErrDeviceNotAttached = errors.New("iot: device is not attached to this gateway")
+
+// attachedDevice tracks enough state about a device attached to this gateway to replay the attach
+// handshake and its config subscription after a reconnect, since Cloud IoT Core requires both to be
+// redone on every new MQTT session.
+type attachedDevice struct {
+	authJWT       string
+	configHandler ConfigHandler
+}
+
+func (t *thing) attachTopic(deviceID string) string {
+	return fmt.Sprintf("/devices/%s/attach", deviceID)
+}
+
+func (t *thing) detachTopic(deviceID string) string {
+	return fmt.Sprintf("/devices/%s/detach", deviceID)
+}
+
+func (t *thing) configTopicFor(deviceID string) string {
+	return fmt.Sprintf("/devices/%s/config", deviceID)
+}
+
+func (t *thing) stateTopicFor(deviceID string) string {
+	return fmt.Sprintf("/devices/%s/state", deviceID)
+}
+
+func (t *thing) eventsTopicFor(deviceID string, subfolder ...string) string {
+	topic := fmt.Sprintf("/devices/%s/events", deviceID)
+	for _, s := range subfolder {
+		topic = topic + "/" + s
+	}
+	return topic
+}
+
+// AttachDevice attaches another device to the gateway by publishing to its /attach topic. authJWT is
+// the attached device's own authentication JWT, or "" if it authenticates using the gateway's
+// credentials.
+func (t *thing) AttachDevice(ctx context.Context, deviceID string, authJWT string) error {
+	if t.options.ID == nil || !t.options.ID.IsGateway {
+		return ErrNotAGateway
+	}
+
+	if err := t.publishAttach(ctx, deviceID, authJWT); err != nil {
+		return err
+	}
+
+	t.attachedMutex.Lock()
+	defer t.attachedMutex.Unlock()
+	if t.attachedDevices == nil {
+		t.attachedDevices = make(map[string]*attachedDevice)
+	}
+	if d := t.attachedDevices[deviceID]; d != nil {
+		d.authJWT = authJWT
+	} else {
+		t.attachedDevices[deviceID] = &attachedDevice{authJWT: authJWT}
+	}
+	return nil
+}
+
+func (t *thing) publishAttach(ctx context.Context, deviceID string, authJWT string) error {
+	payload := []byte("{}")
+	if authJWT != "" {
+		payload = []byte(fmt.Sprintf(`{"authorization":%q}`, authJWT))
+	}
+	return t.client.Publish(ctx, t.attachTopic(deviceID), AttachQOS, payload)
+}
+
+// DetachDevice detaches a device that was previously attached with AttachDevice by publishing to its
+// /detach topic.
+func (t *thing) DetachDevice(ctx context.Context, deviceID string) error {
+	if t.options.ID == nil || !t.options.ID.IsGateway {
+		return ErrNotAGateway
+	}
+
+	if err := t.client.Publish(ctx, t.detachTopic(deviceID), AttachQOS, []byte("{}")); err != nil {
+		return err
+	}
+
+	t.attachedMutex.Lock()
+	defer t.attachedMutex.Unlock()
+	delete(t.attachedDevices, deviceID)
+	return nil
+}
+
+func (t *thing) isAttached(deviceID string) bool {
+	t.attachedMutex.Lock()
+	defer t.attachedMutex.Unlock()
+	return t.attachedDevices[deviceID] != nil
+}
+
+func (t *thing) PublishEventAs(ctx context.Context, deviceID string, payload []byte, subfolder ...string) error {
+	if !t.isAttached(deviceID) {
+		return ErrDeviceNotAttached
+	}
+	return t.publish(ctx, t.eventsTopicFor(deviceID, subfolder...), t.options.EventQOS, payload)
+}
+
+func (t *thing) PublishStateAs(ctx context.Context, deviceID string, payload []byte) error {
+	if !t.isAttached(deviceID) {
+		return ErrDeviceNotAttached
+	}
+	return t.publish(ctx, t.stateTopicFor(deviceID), t.options.StateQOS, payload)
+}
+
+func (t *thing) SubscribeConfigAs(ctx context.Context, deviceID string, handler ConfigHandler) error {
+	if !t.isAttached(deviceID) {
+		return ErrDeviceNotAttached
+	}
+
+	if err := t.subscribeConfigFor(ctx, deviceID, handler); err != nil {
+		return err
+	}
+
+	t.attachedMutex.Lock()
+	defer t.attachedMutex.Unlock()
+	if d := t.attachedDevices[deviceID]; d != nil {
+		d.configHandler = handler
+	}
+	return nil
+}
+
+func (t *thing) subscribeConfigFor(ctx context.Context, deviceID string, handler ConfigHandler) error {
+	return t.client.Subscribe(ctx, t.configTopicFor(deviceID), t.options.ConfigQOS, func(topic string, payload []byte) {
+		ctx, payload, span := t.startReceiveSpan(context.Background(), topic, payload)
+		defer span.End()
+		t.recordReceive(ctx, topic)
+		handler(t, payload)
+	})
+}
+
+// reattachDevices re-publishes the attach handshake and re-subscribes the config handler for every
+// device currently attached to this gateway. It's called after a reconnect, since Cloud IoT Core treats
+// each new MQTT session as starting with no attached devices.
+func (t *thing) reattachDevices(ctx context.Context) error {
+	t.attachedMutex.Lock()
+	devices := make(map[string]*attachedDevice, len(t.attachedDevices))
+	for deviceID, d := range t.attachedDevices {
+		devices[deviceID] = d
+	}
+	t.attachedMutex.Unlock()
+
+	for deviceID, d := range devices {
+		if err := t.publishAttach(ctx, deviceID, d.authJWT); err != nil {
+			return err
+		}
+		if d.configHandler != nil {
+			if err := t.subscribeConfigFor(ctx, deviceID, d.configHandler); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+var GatewayID = &iot.ID{
+	ProjectID: "test-project",
+	Location:  "test-location",
+	Registry:  "test-registry",
+	DeviceID:  "test-gateway",
+	IsGateway: true,
+}
+
+func newGatewayThing(t *testing.T) (iot.Thing, *iot.MockMQTTClient) {
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(thing iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(thing, o)
+		return mockClient
+	}
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(GatewayID, credentials)
+	thing := iot.New(options)
+
+	ctx := context.Background()
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	t.Cleanup(func() { thing.Disconnect(ctx) })
+
+	return thing, mockClient
+}
+
+func TestGatewayAttachDetach(t *testing.T) {
+	ctx := context.Background()
+	thing, mockClient := newGatewayThing(t)
+
+	if err := thing.AttachDevice(ctx, "attached-device", ""); err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+
+	attachTopic := "/devices/attached-device/attach"
+	l, ok := mockClient.Messages[attachTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Attach message not published. Topic: %v", attachTopic)
+	}
+
+	if err := thing.DetachDevice(ctx, "attached-device"); err != nil {
+		t.Fatalf("Couldn't detach device: %v", err)
+	}
+
+	detachTopic := "/devices/attached-device/detach"
+	l, ok = mockClient.Messages[detachTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Detach message not published. Topic: %v", detachTopic)
+	}
+
+	if err := thing.PublishEventAs(ctx, "attached-device", []byte("event")); err != iot.ErrDeviceNotAttached {
+		t.Fatalf("Expected ErrDeviceNotAttached after detach, got: %v", err)
+	}
+}
+
+func TestGatewayPublishAndSubscribeAs(t *testing.T) {
+	ctx := context.Background()
+	thing, mockClient := newGatewayThing(t)
+
+	if err := thing.AttachDevice(ctx, "attached-device", "attached-device-jwt"); err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+
+	attachTopic := "/devices/attached-device/attach"
+	l, ok := mockClient.Messages[attachTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Attach message not published. Topic: %v", attachTopic)
+	}
+	if string(l[0].([]byte)) != `{"authorization":"attached-device-jwt"}` {
+		t.Fatalf("Wrong attach payload: %v", string(l[0].([]byte)))
+	}
+
+	if err := thing.PublishEventAs(ctx, "attached-device", []byte("telemetry")); err != nil {
+		t.Fatalf("Couldn't publish event as attached device: %v", err)
+	}
+
+	eventsTopic := "/devices/attached-device/events"
+	l, ok = mockClient.Messages[eventsTopic]
+	if !ok || len(l) != 1 || string(l[0].([]byte)) != "telemetry" {
+		t.Fatalf("Event not published as attached device. Topic: %v", eventsTopic)
+	}
+
+	if err := thing.PublishStateAs(ctx, "attached-device", []byte("state")); err != nil {
+		t.Fatalf("Couldn't publish state as attached device: %v", err)
+	}
+
+	stateTopic := "/devices/attached-device/state"
+	l, ok = mockClient.Messages[stateTopic]
+	if !ok || len(l) != 1 || string(l[0].([]byte)) != "state" {
+		t.Fatalf("State not published as attached device. Topic: %v", stateTopic)
+	}
+
+	received := ""
+	if err := thing.SubscribeConfigAs(ctx, "attached-device", func(t iot.Thing, config []byte) {
+		received = string(config)
+	}); err != nil {
+		t.Fatalf("Couldn't subscribe to config as attached device: %v", err)
+	}
+
+	mockClient.Receive("/devices/attached-device/config", []byte("attached config"))
+	if received != "attached config" {
+		t.Fatalf("Wrong config received for attached device: %v", received)
+	}
+}
+
+func TestGatewayRequiresGatewayRole(t *testing.T) {
+	ctx := context.Background()
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(TestID, credentials)
+	thing := iot.New(options)
+
+	if err := thing.AttachDevice(ctx, "attached-device", ""); err != iot.ErrNotAGateway {
+		t.Fatalf("Expected ErrNotAGateway, got: %v", err)
+	}
+}
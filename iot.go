@@ -0,0 +1,370 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+// Package iot provides a simple way to connect "things" to Google's Cloud IoT Core.
+package iot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultAuthTokenExpiration is the default amount of time that a generated authentication token is valid for.
+const DefaultAuthTokenExpiration = time.Hour * 2
+
+// ErrConfigurationError is returned when a Thing is used without a valid ID and Credentials configured.
+var ErrConfigurationError = errors.New("iot: thing is not configured correctly")
+
+// LoggerFunc is used by ThingOptions to allow the caller to plug in their own logging implementation.
+type LoggerFunc func(a ...interface{})
+
+// ConfigHandler is called whenever a new configuration is received on the /config topic.
+type ConfigHandler func(thing Thing, config []byte)
+
+// CommandHandler is called whenever a command is received on the /commands topic or one of its
+// subfolders. subfolder is the portion of the topic after "/commands/", or "" if the command was
+// published directly to /commands.
+type CommandHandler func(thing Thing, subfolder string, payload []byte)
+
+// ID identifies a single device registered with Google Cloud IoT Core.
+type ID struct {
+	ProjectID string
+	Location  string
+	Registry  string
+	DeviceID  string
+
+	// IsGateway marks this device as a gateway, allowing it to proxy MQTT traffic on behalf of other
+	// devices attached to it with Thing.AttachDevice.
+	IsGateway bool
+}
+
+// ClientID returns the MQTT client id that Google Cloud IoT Core expects for this device.
+func (id *ID) ClientID() string {
+	return fmt.Sprintf("projects/%s/locations/%s/registries/%s/devices/%s", id.ProjectID, id.Location, id.Registry, id.DeviceID)
+}
+
+// ThingOptions configures a Thing. Use DefaultOptions to create a ThingOptions with sensible defaults.
+type ThingOptions struct {
+	ID          *ID
+	Credentials *Credentials
+
+	EventQOS   byte
+	StateQOS   byte
+	ConfigQOS  byte
+	CommandQOS byte
+
+	// AuthTokenExpiration is how long a generated JWT is valid for before it must be regenerated. It is
+	// clamped to MaxAuthTokenExpiration when scheduling the next refresh.
+	AuthTokenExpiration time.Duration
+
+	// TokenRefreshLeadTime is how long before the auth token expires that it should be regenerated and
+	// the connection refreshed. Defaults to 20% of AuthTokenExpiration (i.e. the token is refreshed
+	// once 80% of its life has elapsed).
+	TokenRefreshLeadTime time.Duration
+
+	// ReconnectBackoff returns how long to wait before the given reconnect attempt (0-based), used
+	// both after a token refresh and after a dropped connection. Defaults to DefaultReconnectBackoff.
+	ReconnectBackoff func(attempt int) time.Duration
+
+	// MessageStore queues messages that couldn't be published while disconnected, so they can be
+	// flushed once the connection is restored. Defaults to a MemoryStore.
+	MessageStore MessageStore
+
+	// DefaultCodec is used by PublishEventTyped and RegisterConfigHandlerTyped to marshal and
+	// unmarshal typed payloads. Defaults to JSONCodec.
+	DefaultCodec Codec
+
+	ConfigHandler  ConfigHandler
+	CommandHandler CommandHandler
+
+	DebugLogger LoggerFunc
+	InfoLogger  LoggerFunc
+	ErrorLogger LoggerFunc
+	LogMQTT     bool
+
+	// TracerProvider is used to create the spans emitted around Connect, publishing, and dispatching
+	// received messages. Defaults to the global otel.GetTracerProvider(), which is a no-op until the
+	// caller configures one. Setting it also enables trace context propagation over MQTT.
+	TracerProvider trace.TracerProvider
+	// MeterProvider is used to create the counters, histograms, and gauge described in the package
+	// documentation. Defaults to the global otel.GetMeterProvider(), which is a no-op until the caller
+	// configures one.
+	MeterProvider metric.MeterProvider
+}
+
+// DefaultOptions returns a ThingOptions populated with the QOS levels and token expiration recommended
+// by Google Cloud IoT Core.
+func DefaultOptions(id *ID, credentials *Credentials) *ThingOptions {
+	return &ThingOptions{
+		ID:                  id,
+		Credentials:         credentials,
+		EventQOS:            1,
+		StateQOS:            1,
+		ConfigQOS:           2,
+		CommandQOS:          1,
+		AuthTokenExpiration: DefaultAuthTokenExpiration,
+		MessageStore:        NewMemoryStore(),
+		DefaultCodec:        JSONCodec{},
+	}
+}
+
+// Thing represents a single device connected to Google Cloud IoT Core.
+type Thing interface {
+	// Connect connects to the given MQTT server. It is a no-op if already connected.
+	Connect(ctx context.Context, server string) error
+	// Disconnect disconnects from the MQTT server.
+	Disconnect(ctx context.Context)
+	// IsConnected returns true if the thing is currently connected.
+	IsConnected() bool
+	// PublishEvent publishes a telemetry event, optionally to a subfolder of /events.
+	PublishEvent(ctx context.Context, payload []byte, subfolder ...string) error
+	// PublishState publishes the current device state to /state.
+	PublishState(ctx context.Context, payload []byte) error
+
+	// AttachDevice attaches another device to this gateway, as described by Google Cloud IoT Core's
+	// gateway protocol. authJWT is the attached device's own authentication JWT, or "" if it
+	// authenticates using the gateway's credentials. The ID this Thing was created with must have
+	// IsGateway set.
+	AttachDevice(ctx context.Context, deviceID string, authJWT string) error
+	// DetachDevice detaches a device that was previously attached with AttachDevice.
+	DetachDevice(ctx context.Context, deviceID string) error
+	// PublishEventAs publishes a telemetry event on behalf of an attached device.
+	PublishEventAs(ctx context.Context, deviceID string, payload []byte, subfolder ...string) error
+	// PublishStateAs publishes device state on behalf of an attached device.
+	PublishStateAs(ctx context.Context, deviceID string, payload []byte) error
+	// SubscribeConfigAs subscribes to configuration updates for an attached device.
+	SubscribeConfigAs(ctx context.Context, deviceID string, handler ConfigHandler) error
+}
+
+// NewClient is called by New to create the underlying MQTTClient. It is a variable so that it can be
+// overridden in tests with a mock implementation.
+var NewClient = func(thing Thing, options *ThingOptions) MQTTClient {
+	return newPahoClient(thing, options)
+}
+
+type thing struct {
+	options   *ThingOptions
+	client    MQTTClient
+	server    string
+	telemetry *telemetry
+
+	attachedMutex   sync.Mutex
+	attachedDevices map[string]*attachedDevice
+
+	// configHandlerMutex guards options.ConfigHandler, which handleConfig reads from the MQTT client's
+	// delivery goroutine and RegisterConfigHandlerTyped can replace at any time.
+	configHandlerMutex sync.Mutex
+
+	refreshMutex sync.Mutex
+	refreshStop  chan struct{}
+	refreshDone  chan struct{}
+
+	// refreshExpiration and refreshLeadTime are snapshotted from ThingOptions by
+	// captureTokenRefreshSettings when Connect is called, so the background refresh loop never reads
+	// ThingOptions fields concurrently with another caller.
+	refreshExpiration time.Duration
+	refreshLeadTime   time.Duration
+}
+
+// New creates a new Thing using the given options. The underlying MQTT client isn't connected until
+// Connect is called.
+func New(options *ThingOptions) Thing {
+	t := &thing{options: options, telemetry: newTelemetry(options)}
+	t.client = NewClient(t, options)
+	return t
+}
+
+func (t *thing) configTopic() string {
+	return fmt.Sprintf("/devices/%s/config", t.options.ID.DeviceID)
+}
+
+func (t *thing) stateTopic() string {
+	return fmt.Sprintf("/devices/%s/state", t.options.ID.DeviceID)
+}
+
+func (t *thing) commandsTopic() string {
+	return fmt.Sprintf("/devices/%s/commands/#", t.options.ID.DeviceID)
+}
+
+func (t *thing) eventsTopic(subfolder ...string) string {
+	topic := fmt.Sprintf("/devices/%s/events", t.options.ID.DeviceID)
+	for _, s := range subfolder {
+		topic = topic + "/" + s
+	}
+	return topic
+}
+
+func (t *thing) Connect(ctx context.Context, server string) error {
+	ctx, span := t.telemetry.tracer.Start(ctx, "iot.Connect", trace.WithAttributes(
+		attribute.String("messaging.url", server),
+	))
+	defer span.End()
+
+	if t.IsConnected() {
+		return nil
+	}
+
+	if t.options.ID == nil || t.options.Credentials == nil {
+		span.RecordError(ErrConfigurationError)
+		span.SetStatus(codes.Error, ErrConfigurationError.Error())
+		return ErrConfigurationError
+	}
+
+	t.server = server
+
+	if err := t.client.Connect(ctx, server); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	t.telemetry.connectionState.Add(ctx, 1)
+
+	if err := t.subscribeAll(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	if err := t.flushMessageStore(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	t.captureTokenRefreshSettings()
+	t.startTokenRefresh(ctx)
+
+	return nil
+}
+
+func (t *thing) subscribeAll(ctx context.Context) error {
+	if err := t.client.Subscribe(ctx, t.configTopic(), t.options.ConfigQOS, t.handleConfig); err != nil {
+		return err
+	}
+
+	if t.options.CommandHandler != nil {
+		if err := t.client.Subscribe(ctx, t.commandsTopic(), t.options.CommandQOS, t.handleCommand); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushMessageStore publishes every message queued in options.MessageStore, in order, removing each
+// one as soon as it has been published successfully.
+func (t *thing) flushMessageStore(ctx context.Context) error {
+	if t.options.MessageStore == nil {
+		return nil
+	}
+
+	messages, err := t.options.MessageStore.List()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		if err := t.client.Publish(ctx, m.Topic, m.QOS, m.Payload); err != nil {
+			return err
+		}
+		if err := t.options.MessageStore.Delete(m.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *thing) Disconnect(ctx context.Context) {
+	t.stopTokenRefresh()
+	t.client.Disconnect(ctx)
+	t.telemetry.connectionState.Add(ctx, -1)
+}
+
+func (t *thing) IsConnected() bool {
+	return t.client.IsConnected()
+}
+
+func (t *thing) PublishEvent(ctx context.Context, payload []byte, subfolder ...string) error {
+	return t.publish(ctx, t.eventsTopic(subfolder...), t.options.EventQOS, payload)
+}
+
+func (t *thing) PublishState(ctx context.Context, payload []byte) error {
+	return t.publish(ctx, t.stateTopic(), t.options.StateQOS, payload)
+}
+
+// publish sends payload to topic if connected, or queues it in options.MessageStore otherwise so it
+// can be flushed once the connection is restored.
+func (t *thing) publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	start := time.Now()
+	ctx, span := t.telemetry.tracer.Start(ctx, "iot.Publish", trace.WithAttributes(
+		attribute.String("messaging.destination", topic),
+	))
+	defer span.End()
+
+	wirePayload := t.encodeEnvelope(ctx, payload)
+
+	var err error
+	if !t.IsConnected() && t.options.MessageStore != nil {
+		_, err = t.options.MessageStore.Put(topic, qos, wirePayload)
+		if queued, listErr := t.options.MessageStore.List(); listErr == nil {
+			t.telemetry.queueDepth.Record(ctx, int64(len(queued)))
+		}
+	} else {
+		err = t.client.Publish(ctx, topic, qos, wirePayload)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	t.recordPublish(ctx, topic, start, err)
+	return err
+}
+
+// configHandler returns the current options.ConfigHandler, synchronized with setConfigHandler.
+func (t *thing) configHandler() ConfigHandler {
+	t.configHandlerMutex.Lock()
+	defer t.configHandlerMutex.Unlock()
+	return t.options.ConfigHandler
+}
+
+// setConfigHandler replaces options.ConfigHandler, synchronized with configHandler.
+func (t *thing) setConfigHandler(handler ConfigHandler) {
+	t.configHandlerMutex.Lock()
+	defer t.configHandlerMutex.Unlock()
+	t.options.ConfigHandler = handler
+}
+
+func (t *thing) handleConfig(topic string, payload []byte) {
+	ctx, payload, span := t.startReceiveSpan(context.Background(), topic, payload)
+	defer span.End()
+	t.recordReceive(ctx, topic)
+
+	if handler := t.configHandler(); handler != nil {
+		handler(t, payload)
+	}
+}
+
+func (t *thing) handleCommand(topic string, payload []byte) {
+	if t.options.CommandHandler == nil {
+		return
+	}
+
+	ctx, payload, span := t.startReceiveSpan(context.Background(), topic, payload)
+	defer span.End()
+	t.recordReceive(ctx, topic)
+
+	subfolder := strings.TrimPrefix(topic, fmt.Sprintf("/devices/%s/commands", t.options.ID.DeviceID))
+	subfolder = strings.TrimPrefix(subfolder, "/")
+	t.options.CommandHandler(t, subfolder, payload)
+}
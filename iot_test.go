@@ -282,3 +282,109 @@ func doEventTest(t *testing.T, thing iot.Thing, mockClient *iot.MockMQTTClient)
 		}
 	}
 }
+
+func TestMessageStoreFlushedOnConnect(t *testing.T) {
+	ctx := context.Background()
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return mockClient
+	}
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(TestID, credentials)
+	store := iot.NewMemoryStore()
+	options.MessageStore = store
+
+	thing := iot.New(options)
+
+	if err := thing.PublishEvent(ctx, []byte("queued while offline")); err != nil {
+		t.Fatalf("Couldn't queue event: %v", err)
+	}
+
+	if len(mockClient.Messages[EventsTopic]) != 0 {
+		t.Fatal("Event was published immediately instead of being queued")
+	}
+
+	queued, err := store.List()
+	if err != nil {
+		t.Fatalf("Couldn't list queued messages: %v", err)
+	}
+	if len(queued) != 1 {
+		t.Fatalf("Wrong number of queued messages: %v", len(queued))
+	}
+
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	l, ok := mockClient.Messages[EventsTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Queued event wasn't flushed on connect. Topic: %v", EventsTopic)
+	}
+	if string(l[0].([]byte)) != "queued while offline" {
+		t.Fatalf("Wrong message flushed: %v", string(l[0].([]byte)))
+	}
+
+	queued, err = store.List()
+	if err != nil {
+		t.Fatalf("Couldn't list queued messages: %v", err)
+	}
+	if len(queued) != 0 {
+		t.Fatalf("Flushed message wasn't removed from the store: %v", len(queued))
+	}
+}
+
+func TestThingCommands(t *testing.T) {
+	ctx := context.Background()
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return mockClient
+	}
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	var receivedSubfolder string
+	var receivedPayload string
+
+	options := iot.DefaultOptions(TestID, credentials)
+	options.CommandHandler = func(thing iot.Thing, subfolder string, payload []byte) {
+		receivedSubfolder = subfolder
+		receivedPayload = string(payload)
+	}
+
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	if len(mockClient.Subscriptions) != 2 {
+		t.Fatalf("Wrong number of subscriptions: %v", len(mockClient.Subscriptions))
+	}
+
+	mockClient.Receive("/devices/test-device/commands", []byte("top level command"))
+	if receivedSubfolder != "" {
+		t.Fatalf("Wrong subfolder for top level command: %v", receivedSubfolder)
+	}
+	if receivedPayload != "top level command" {
+		t.Fatalf("Wrong payload for top level command: %v", receivedPayload)
+	}
+
+	mockClient.Receive("/devices/test-device/commands/relay/1", []byte("turn on"))
+	if receivedSubfolder != "relay/1" {
+		t.Fatalf("Wrong subfolder for command: %v", receivedSubfolder)
+	}
+	if receivedPayload != "turn on" {
+		t.Fatalf("Wrong payload for command: %v", receivedPayload)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// MockMQTTClient is an MQTTClient implementation that records everything sent to it instead of talking
+// to a real broker. It's exported so that callers can write tests for their own ConfigHandler and
+// CommandHandler implementations the same way this package's own tests do. It's safe for concurrent
+// use, since Thing's token refresh loop calls it from a background goroutine.
+type MockMQTTClient struct {
+	Options             *ThingOptions
+	ClientID            string
+	CredentialsProvider CredentialsProvider
+	DebugLogger         LoggerFunc
+	InfoLogger          LoggerFunc
+	ErrorLogger         LoggerFunc
+
+	Connected   bool
+	ConnectedTo []string
+
+	// CredentialCallCount is incremented every time Connect asks CredentialsProvider for a fresh
+	// username and password, mirroring how a real MQTT client fetches credentials on every (re)connect.
+	CredentialCallCount int
+
+	Subscriptions map[string]MessageHandler
+	Messages      map[string][]interface{}
+
+	mutex sync.Mutex
+}
+
+// NewMockClient creates a MockMQTTClient for the given thing and options. It's typically installed by
+// overriding the package-level NewClient variable in a test's setup code.
+func NewMockClient(thing Thing, options *ThingOptions) *MockMQTTClient {
+	m := &MockMQTTClient{
+		Options:       options,
+		DebugLogger:   options.DebugLogger,
+		InfoLogger:    options.InfoLogger,
+		ErrorLogger:   options.ErrorLogger,
+		Subscriptions: make(map[string]MessageHandler),
+		Messages:      make(map[string][]interface{}),
+	}
+	if options.ID != nil {
+		m.ClientID = options.ID.ClientID()
+	}
+	if options.ID != nil && options.Credentials != nil {
+		m.CredentialsProvider = NewCredentialsProvider(options.ID, options.Credentials, options.AuthTokenExpiration)
+	}
+	return m
+}
+
+// Connect asks CredentialsProvider for a fresh username and password, just like a real MQTT client
+// would, then records the server it was asked to connect to and marks the client as connected.
+func (m *MockMQTTClient) Connect(ctx context.Context, server string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.CredentialsProvider != nil {
+		m.CredentialsProvider()
+		m.CredentialCallCount++
+	}
+	m.Connected = true
+	m.ConnectedTo = append(m.ConnectedTo, server)
+	return nil
+}
+
+// Disconnect marks the client as disconnected.
+func (m *MockMQTTClient) Disconnect(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Connected = false
+}
+
+// IsConnected returns whether Connect has been called without a matching Disconnect.
+func (m *MockMQTTClient) IsConnected() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.Connected
+}
+
+// Publish records the payload published to topic so that tests can assert on it.
+func (m *MockMQTTClient) Publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Messages[topic] = append(m.Messages[topic], payload)
+	return nil
+}
+
+// Subscribe records the handler registered for topic.
+func (m *MockMQTTClient) Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Subscriptions[topic] = handler
+	return nil
+}
+
+// Snapshot returns the current CredentialCallCount and a copy of ConnectedTo, synchronized with Connect.
+// Tests that read these values from a goroutine other than the one that called Connect — for example
+// while a Thing's background token refresh loop is running concurrently — should use this instead of
+// reading the fields directly, to avoid a data race.
+func (m *MockMQTTClient) Snapshot() (credentialCallCount int, connectedTo []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.CredentialCallCount, append([]string(nil), m.ConnectedTo...)
+}
+
+// Receive simulates a message arriving from the broker on topic, dispatching it to whichever
+// subscription matches, including wildcard ("#") subscriptions.
+func (m *MockMQTTClient) Receive(topic string, payload []byte) {
+	m.mutex.Lock()
+	handler, ok := m.Subscriptions[topic]
+	if !ok {
+		for subscription, h := range m.Subscriptions {
+			if matchesTopic(subscription, topic) {
+				handler, ok = h, true
+				break
+			}
+		}
+	}
+	m.mutex.Unlock()
+
+	if ok {
+		handler(topic, payload)
+	}
+}
+
+// matchesTopic reports whether topic matches subscription, which may end in the MQTT multi-level
+// wildcard "#".
+func matchesTopic(subscription string, topic string) bool {
+	if !strings.HasSuffix(subscription, "/#") {
+		return subscription == topic
+	}
+	prefix := strings.TrimSuffix(subscription, "/#")
+	return topic == prefix || strings.HasPrefix(topic, prefix+"/")
+}
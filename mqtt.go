@@ -0,0 +1,100 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MessageHandler is called whenever a message is received on a subscribed topic.
+type MessageHandler func(topic string, payload []byte)
+
+// MQTTClient is the interface used by Thing to talk to the underlying MQTT broker. It exists so that
+// tests can substitute MockMQTTClient instead of connecting to a real broker.
+type MQTTClient interface {
+	Connect(ctx context.Context, server string) error
+	Disconnect(ctx context.Context)
+	IsConnected() bool
+	Publish(ctx context.Context, topic string, qos byte, payload []byte) error
+	Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error
+}
+
+// pahoClient is the default MQTTClient implementation, backed by the Eclipse Paho MQTT client.
+type pahoClient struct {
+	options *ThingOptions
+	client  paho.Client
+}
+
+func newPahoClient(thing Thing, options *ThingOptions) MQTTClient {
+	return &pahoClient{options: options}
+}
+
+func (c *pahoClient) Connect(ctx context.Context, server string) error {
+	provider := NewCredentialsProvider(c.options.ID, c.options.Credentials, c.options.AuthTokenExpiration)
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(server)
+	opts.SetClientID(c.options.ID.ClientID())
+	opts.SetCredentialsProvider(paho.CredentialsProvider(provider))
+
+	if c.options.LogMQTT {
+		if c.options.DebugLogger != nil {
+			paho.DEBUG = logAdapter(c.options.DebugLogger)
+		}
+		if c.options.ErrorLogger != nil {
+			paho.ERROR = logAdapter(c.options.ErrorLogger)
+		}
+	}
+
+	c.client = paho.NewClient(opts)
+	token := c.client.Connect()
+	if !token.WaitTimeout(30 * time.Second) {
+		return token.Error()
+	}
+	return token.Error()
+}
+
+func (c *pahoClient) Disconnect(ctx context.Context) {
+	if c.client != nil {
+		c.client.Disconnect(250)
+	}
+}
+
+func (c *pahoClient) IsConnected() bool {
+	return c.client != nil && c.client.IsConnected()
+}
+
+func (c *pahoClient) Publish(ctx context.Context, topic string, qos byte, payload []byte) error {
+	token := c.client.Publish(topic, qos, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (c *pahoClient) Subscribe(ctx context.Context, topic string, qos byte, handler MessageHandler) error {
+	token := c.client.Subscribe(topic, qos, func(_ paho.Client, msg paho.Message) {
+		handler(msg.Topic(), msg.Payload())
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// logAdapter lets a LoggerFunc satisfy paho's internal *log.Logger-shaped logging interface.
+func logAdapter(logger LoggerFunc) pahoLogger {
+	return pahoLogger{logger}
+}
+
+type pahoLogger struct {
+	logger LoggerFunc
+}
+
+func (l pahoLogger) Println(v ...interface{}) {
+	l.logger(v...)
+}
+
+func (l pahoLogger) Printf(format string, v ...interface{}) {
+	l.logger(v)
+}
@@ -0,0 +1,312 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// QueuedMessage is a single message that couldn't be published immediately and is waiting in a
+// MessageStore until the connection is restored.
+type QueuedMessage struct {
+	ID      string
+	Topic   string
+	QOS     byte
+	Payload []byte
+}
+
+// MessageStore persists messages that couldn't be published while a Thing was disconnected. Thing
+// flushes every message returned by List, in order, as soon as it reconnects. Implementations must be
+// safe for concurrent use.
+type MessageStore interface {
+	// Put queues payload for topic and returns the id it was stored under.
+	Put(topic string, qos byte, payload []byte) (id string, err error)
+	// Get returns the message previously stored under id, or nil if there isn't one.
+	Get(id string) (*QueuedMessage, error)
+	// Delete removes the message stored under id.
+	Delete(id string) error
+	// List returns every queued message, oldest first.
+	List() ([]*QueuedMessage, error)
+}
+
+// MemoryStore is a MessageStore that keeps queued messages in memory. Queued messages are lost if the
+// process restarts, which makes it a reasonable default for things that don't need delivery guarantees
+// across a power cycle.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	nextID   uint64
+	messages map[string]*QueuedMessage
+	order    []string
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: make(map[string]*QueuedMessage)}
+}
+
+// Put implements MessageStore.
+func (s *MemoryStore) Put(topic string, qos byte, payload []byte) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := s.allocateID()
+	s.messages[id] = &QueuedMessage{ID: id, Topic: topic, QOS: qos, Payload: payload}
+	s.order = append(s.order, id)
+	return id, nil
+}
+
+func (s *MemoryStore) allocateID() string {
+	s.nextID++
+	return fmt.Sprintf("%020d", s.nextID)
+}
+
+// Get implements MessageStore.
+func (s *MemoryStore) Get(id string) (*QueuedMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.messages[id], nil
+}
+
+// Delete implements MessageStore.
+func (s *MemoryStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.messages, id)
+	for i, existing := range s.order {
+		if existing == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// List implements MessageStore.
+func (s *MemoryStore) List() ([]*QueuedMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]*QueuedMessage, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.messages[id])
+	}
+	return list, nil
+}
+
+// FileStore is a MessageStore that persists each queued message as its own file in Directory. It
+// replaces the old ThingOptions.QueueDirectory based queue.
+type FileStore struct {
+	Directory string
+
+	mutex  sync.Mutex
+	nextID uint64
+}
+
+// NewFileStore creates a FileStore that persists queued messages under directory, creating it if
+// necessary. If directory already contains messages from a previous process, nextID is seeded past the
+// highest existing id so new messages don't reuse an id still holding an undelivered message.
+func NewFileStore(directory string) (*FileStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var maxID uint64
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		if id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ".json"), 10, 64); err == nil && id > maxID {
+			maxID = id
+		}
+	}
+
+	return &FileStore{Directory: directory, nextID: maxID}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.Directory, id+".json")
+}
+
+func (s *FileStore) allocateID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	return fmt.Sprintf("%020d", s.nextID)
+}
+
+// Put implements MessageStore.
+func (s *FileStore) Put(topic string, qos byte, payload []byte) (string, error) {
+	id := s.allocateID()
+	message := &QueuedMessage{ID: id, Topic: topic, QOS: qos, Payload: payload}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	return id, ioutil.WriteFile(s.path(id), data, 0600)
+}
+
+// Get implements MessageStore.
+func (s *FileStore) Get(id string) (*QueuedMessage, error) {
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	message := &QueuedMessage{}
+	if err := json.Unmarshal(data, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Delete implements MessageStore.
+func (s *FileStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements MessageStore. Messages are returned in id order, which is also the order they were
+// queued in since ids are monotonically increasing and zero-padded.
+func (s *FileStore) List() ([]*QueuedMessage, error) {
+	entries, err := ioutil.ReadDir(s.Directory)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*QueuedMessage, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		message, err := s.Get(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if message != nil {
+			list = append(list, message)
+		}
+	}
+	return list, nil
+}
+
+var messageBucket = []byte("messages")
+
+// BoltStore is a MessageStore backed by a single bbolt database file, a good fit for devices with
+// flash storage where a directory of small files isn't ideal.
+type BoltStore struct {
+	db *bolt.DB
+
+	mutex  sync.Mutex
+	nextID uint64
+}
+
+// NewBoltStore opens (creating if necessary) a bbolt database at path to use as a MessageStore. If the
+// database already contains messages from a previous process, nextID is seeded past the highest existing
+// key so new messages don't reuse an id still holding an undelivered message.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var maxID uint64
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(messageBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if id, err := strconv.ParseUint(string(k), 10, 64); err == nil && id > maxID {
+				maxID = id
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db, nextID: maxID}, nil
+}
+
+// Close closes the underlying bbolt database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) allocateID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextID++
+	return fmt.Sprintf("%020d", s.nextID)
+}
+
+// Put implements MessageStore.
+func (s *BoltStore) Put(topic string, qos byte, payload []byte) (string, error) {
+	id := s.allocateID()
+	message := &QueuedMessage{ID: id, Topic: topic, QOS: qos, Payload: payload}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messageBucket).Put([]byte(id), data)
+	})
+	return id, err
+}
+
+// Get implements MessageStore.
+func (s *BoltStore) Get(id string) (*QueuedMessage, error) {
+	var message *QueuedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(messageBucket).Get([]byte(id))
+		if data == nil {
+			return nil
+		}
+		message = &QueuedMessage{}
+		return json.Unmarshal(data, message)
+	})
+	return message, err
+}
+
+// Delete implements MessageStore.
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(messageBucket).Delete([]byte(id))
+	})
+}
+
+// List implements MessageStore. bbolt iterates keys in byte-sorted order, which is also queue order
+// since ids are monotonically increasing and zero-padded.
+func (s *BoltStore) List() ([]*QueuedMessage, error) {
+	var list []*QueuedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(messageBucket).ForEach(func(k, v []byte) error {
+			message := &QueuedMessage{}
+			if err := json.Unmarshal(v, message); err != nil {
+				return err
+			}
+			list = append(list, message)
+			return nil
+		})
+	})
+	return list, err
+}
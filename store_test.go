@@ -0,0 +1,101 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vaelen/iot"
+)
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := iot.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %v", err)
+	}
+	if _, err := store.Put("/devices/a/events", 1, []byte("first")); err != nil {
+		t.Fatalf("Couldn't queue message: %v", err)
+	}
+
+	// Simulate a process restart by opening a second FileStore over the same directory.
+	restarted, err := iot.NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Couldn't reopen store: %v", err)
+	}
+	if _, err := restarted.Put("/devices/a/events", 1, []byte("second")); err != nil {
+		t.Fatalf("Couldn't queue message: %v", err)
+	}
+
+	messages, err := restarted.List()
+	if err != nil {
+		t.Fatalf("Couldn't list messages: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 queued messages after restart, got %d", len(messages))
+	}
+
+	seen := map[string]bool{}
+	for _, m := range messages {
+		seen[string(m.Payload)] = true
+	}
+	if !seen["first"] || !seen["second"] {
+		t.Fatalf("Restart clobbered an existing message, got: %+v", messages)
+	}
+}
+
+func TestBoltStoreSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore-")
+	if err != nil {
+		t.Fatalf("Couldn't create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.db")
+
+	store, err := iot.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Couldn't create store: %v", err)
+	}
+	if _, err := store.Put("/devices/a/events", 1, []byte("first")); err != nil {
+		t.Fatalf("Couldn't queue message: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Couldn't close store: %v", err)
+	}
+
+	// Simulate a process restart by reopening the same database file.
+	restarted, err := iot.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("Couldn't reopen store: %v", err)
+	}
+	defer restarted.Close()
+
+	if _, err := restarted.Put("/devices/a/events", 1, []byte("second")); err != nil {
+		t.Fatalf("Couldn't queue message: %v", err)
+	}
+
+	messages, err := restarted.List()
+	if err != nil {
+		t.Fatalf("Couldn't list messages: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 queued messages after restart, got %d", len(messages))
+	}
+
+	seen := map[string]bool{}
+	for _, m := range messages {
+		seen[string(m.Payload)] = true
+	}
+	if !seen["first"] || !seen["second"] {
+		t.Fatalf("Restart clobbered an existing message, got: %+v", messages)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/vaelen/iot"
+
+// textMapPropagator injects and extracts the W3C traceparent used by encodeEnvelope/decodeEnvelope. It's
+// a package-level TraceContext propagator, rather than otel.GetTextMapPropagator(), so that envelope
+// propagation works whether or not the caller has set a global propagator.
+var textMapPropagator = propagation.TraceContext{}
+
+// telemetry holds the OpenTelemetry instruments a thing publishes spans and metrics through. It's
+// built once per thing from ThingOptions.TracerProvider / MeterProvider, falling back to the global
+// providers (which are no-ops unless the caller has configured otel.SetTracerProvider /
+// otel.SetMeterProvider) so that instrumentation is always safe to call.
+type telemetry struct {
+	tracer trace.Tracer
+
+	messagesPublished metric.Int64Counter
+	messagesReceived  metric.Int64Counter
+	publishLatency    metric.Float64Histogram
+	queueDepth        metric.Int64Histogram
+	connectionState   metric.Int64UpDownCounter
+}
+
+func newTelemetry(options *ThingOptions) *telemetry {
+	tracerProvider := options.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	meterProvider := options.MeterProvider
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+
+	meter := meterProvider.Meter(instrumentationName)
+	t := &telemetry{tracer: tracerProvider.Tracer(instrumentationName)}
+
+	t.messagesPublished, _ = meter.Int64Counter("iot.messages.published",
+		metric.WithDescription("Number of messages published, by topic."))
+	t.messagesReceived, _ = meter.Int64Counter("iot.messages.received",
+		metric.WithDescription("Number of messages received, by topic."))
+	t.publishLatency, _ = meter.Float64Histogram("iot.publish.latency",
+		metric.WithDescription("Latency of Publish calls, by topic."), metric.WithUnit("s"))
+	t.queueDepth, _ = meter.Int64Histogram("iot.queue.depth",
+		metric.WithDescription("Depth of the MessageStore at publish time, for messages queued while disconnected."))
+	t.connectionState, _ = meter.Int64UpDownCounter("iot.connection.state",
+		metric.WithDescription("1 while connected, 0 while disconnected."))
+
+	return t
+}
+
+// traceEnvelope carries a W3C traceparent alongside the original payload for brokers that don't
+// support MQTT v5 user properties. It's only used when ThingOptions.TracerProvider is set, so
+// publishing without tracing configured never changes the wire payload.
+type traceEnvelope struct {
+	TraceParent string `json:"traceparent"`
+	Payload     []byte `json:"payload"`
+}
+
+// encodeEnvelope wraps payload with the current span context's traceparent, if tracing is configured
+// and ctx carries a span worth propagating. Otherwise it returns payload unchanged.
+func (t *thing) encodeEnvelope(ctx context.Context, payload []byte) []byte {
+	if t.options.TracerProvider == nil {
+		return payload
+	}
+
+	carrier := propagation.MapCarrier{}
+	textMapPropagator.Inject(ctx, carrier)
+	traceParent := carrier.Get("traceparent")
+	if traceParent == "" {
+		return payload
+	}
+
+	data, err := json.Marshal(traceEnvelope{TraceParent: traceParent, Payload: payload})
+	if err != nil {
+		return payload
+	}
+	return data
+}
+
+// decodeEnvelope reverses encodeEnvelope. If payload isn't a trace envelope, it's returned unchanged
+// and ok is false.
+func decodeEnvelope(payload []byte) (envelope traceEnvelope, ok bool) {
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.TraceParent == "" {
+		return traceEnvelope{}, false
+	}
+	return envelope, true
+}
+
+// startReceiveSpan starts a span for a message arriving on topic, linking it to the publisher's span
+// if the payload carries a propagated trace context. It returns the un-enveloped payload to dispatch
+// to the caller's handler.
+func (t *thing) startReceiveSpan(ctx context.Context, topic string, payload []byte) (context.Context, []byte, trace.Span) {
+	attrs := trace.WithAttributes(attribute.String("messaging.destination", topic))
+
+	envelope, ok := decodeEnvelope(payload)
+	if !ok {
+		ctx, span := t.telemetry.tracer.Start(ctx, "iot.Receive", attrs)
+		return ctx, payload, span
+	}
+
+	carrier := propagation.MapCarrier{"traceparent": envelope.TraceParent}
+	linkCtx := textMapPropagator.Extract(context.Background(), carrier)
+	link := trace.LinkFromContext(linkCtx)
+	ctx, span := t.telemetry.tracer.Start(ctx, "iot.Receive", attrs, trace.WithLinks(link))
+	return ctx, envelope.Payload, span
+}
+
+func (t *thing) recordPublish(ctx context.Context, topic string, start time.Time, err error) {
+	attrs := metric.WithAttributes(attribute.String("topic", topic))
+	t.telemetry.publishLatency.Record(ctx, time.Since(start).Seconds(), attrs)
+	if err == nil {
+		t.telemetry.messagesPublished.Add(ctx, 1, attrs)
+	}
+}
+
+func (t *thing) recordReceive(ctx context.Context, topic string) {
+	t.telemetry.messagesReceived.Add(ctx, 1, metric.WithAttributes(attribute.String("topic", topic)))
+}
@@ -0,0 +1,73 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vaelen/iot"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTelemetryPublishSpan(t *testing.T) {
+	ctx := context.Background()
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return mockClient
+	}
+
+	exporter := tracetest.NewInMemoryExporter()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer tracerProvider.Shutdown(ctx)
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(TestID, credentials)
+	options.TracerProvider = tracerProvider
+
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	if err := thing.PublishEvent(ctx, []byte("telemetry")); err != nil {
+		t.Fatalf("Couldn't publish event: %v", err)
+	}
+
+	l, ok := mockClient.Messages[EventsTopic]
+	if !ok || len(l) != 1 {
+		t.Fatalf("Event wasn't published. Topic: %v", EventsTopic)
+	}
+	if string(l[0].([]byte)) == "telemetry" {
+		t.Fatal("Payload should have been wrapped in a trace envelope, but was published raw")
+	}
+
+	var publishSpan *tracetest.SpanStub
+	for i, span := range exporter.GetSpans() {
+		if span.Name == "iot.Publish" {
+			publishSpan = &exporter.GetSpans()[i]
+		}
+	}
+	if publishSpan == nil {
+		t.Fatal("No iot.Publish span was recorded")
+	}
+
+	found := false
+	for _, attr := range publishSpan.Attributes {
+		if attr.Key == attribute.Key("messaging.destination") && attr.Value.AsString() == EventsTopic {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("iot.Publish span is missing the messaging.destination=%v attribute", EventsTopic)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// MaxAuthTokenExpiration is the longest lifetime Google Cloud IoT Core allows for an authentication
+// token. AuthTokenExpiration values longer than this are clamped down to it when scheduling the next
+// token refresh.
+const MaxAuthTokenExpiration = 24 * time.Hour
+
+// TimeAfter is used by the token refresh loop to wait until it's time to refresh the auth token. It is
+// a variable, like NewClient, so that tests can substitute a fake clock.
+var TimeAfter = time.After
+
+// DefaultReconnectBackoff is the ReconnectBackoff used when ThingOptions.ReconnectBackoff is nil. It
+// backs off exponentially starting at one second, caps at one minute, and adds up to 20% jitter so
+// that many devices reconnecting at once don't do so in lockstep.
+func DefaultReconnectBackoff(attempt int) time.Duration {
+	base := time.Second
+	for i := 0; i < attempt && base < time.Minute; i++ {
+		base *= 2
+	}
+	if base > time.Minute {
+		base = time.Minute
+	}
+	jitter := time.Duration(rand.Int63n(int64(base)/5 + 1))
+	return base + jitter
+}
+
+// tokenRefreshLeadTime returns how long before expiration the auth token should be refreshed.
+func (t *thing) tokenRefreshLeadTime() time.Duration {
+	return t.refreshLeadTime
+}
+
+// tokenExpiration returns the auth token lifetime to schedule refreshes against, clamped to
+// MaxAuthTokenExpiration.
+func (t *thing) tokenExpiration() time.Duration {
+	return t.refreshExpiration
+}
+
+// captureTokenRefreshSettings snapshots the auth token timing from ThingOptions onto the thing itself.
+// It's called once from Connect so that the background refresh loop never needs to read ThingOptions
+// concurrently with a caller that might still be holding a reference to it.
+func (t *thing) captureTokenRefreshSettings() {
+	expiration := t.options.AuthTokenExpiration
+	if expiration <= 0 || expiration > MaxAuthTokenExpiration {
+		expiration = MaxAuthTokenExpiration
+	}
+	t.refreshExpiration = expiration
+
+	leadTime := t.options.TokenRefreshLeadTime
+	if leadTime <= 0 {
+		leadTime = expiration / 5
+	}
+	t.refreshLeadTime = leadTime
+}
+
+// startTokenRefresh (re)starts the background goroutine that reconnects, generating a fresh auth
+// token, before the current one expires. It waits for any goroutine started by a previous call to exit
+// first, so that only one is ever running at a time.
+func (t *thing) startTokenRefresh(ctx context.Context) {
+	t.refreshMutex.Lock()
+	prevStop := t.refreshStop
+	prevDone := t.refreshDone
+	if prevStop != nil {
+		close(prevStop)
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	t.refreshStop = stop
+	t.refreshDone = done
+	t.refreshMutex.Unlock()
+
+	if prevDone != nil {
+		<-prevDone
+	}
+
+	go func() {
+		defer close(done)
+		t.refreshTokenLoop(ctx, stop)
+	}()
+}
+
+// stopTokenRefresh stops the background refresh goroutine and waits for it to actually exit, so that
+// once it returns nothing is still reading TimeAfter or the thing's state in the background.
+func (t *thing) stopTokenRefresh() {
+	t.refreshMutex.Lock()
+	stop := t.refreshStop
+	done := t.refreshDone
+	t.refreshStop = nil
+	t.refreshDone = nil
+	t.refreshMutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+func (t *thing) refreshTokenLoop(ctx context.Context, stop chan struct{}) {
+	for {
+		wait := t.tokenExpiration() - t.tokenRefreshLeadTime()
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-TimeAfter(wait):
+		}
+
+		if err := t.reconnect(ctx, stop); err != nil && t.options.ErrorLogger != nil {
+			t.options.ErrorLogger(fmt.Sprintf("iot: couldn't refresh auth token: %v", err))
+		}
+	}
+}
+
+// reconnect forces a fresh MQTT connection, which causes a new auth token to be generated and sent as
+// the password, then resubscribes and flushes any messages queued while disconnected. It retries with
+// ReconnectBackoff, trying the whole sequence again on any failure, until it succeeds or stop is closed.
+func (t *thing) reconnect(ctx context.Context, stop chan struct{}) error {
+	t.client.Disconnect(ctx)
+	t.telemetry.connectionState.Add(ctx, -1)
+
+	backoff := t.options.ReconnectBackoff
+	if backoff == nil {
+		backoff = DefaultReconnectBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.reconnectOnce(ctx)
+		if err == nil {
+			t.telemetry.connectionState.Add(ctx, 1)
+			return nil
+		}
+
+		if t.options.ErrorLogger != nil {
+			t.options.ErrorLogger(fmt.Sprintf("iot: reconnect attempt %d failed: %v", attempt, err))
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-TimeAfter(backoff(attempt)):
+		}
+	}
+}
+
+// reconnectOnce connects (if not already connected), resubscribes, re-attaches any gateway devices, and
+// flushes the message store. A failure at any step makes the whole attempt a failure, so reconnect
+// retries it with backoff instead of leaving the thing partially resubscribed until the next scheduled
+// token refresh.
+func (t *thing) reconnectOnce(ctx context.Context) error {
+	if !t.client.IsConnected() {
+		if err := t.client.Connect(ctx, t.server); err != nil {
+			return err
+		}
+	}
+
+	if err := t.subscribeAll(ctx); err != nil {
+		return err
+	}
+
+	if err := t.reattachDevices(ctx); err != nil {
+		return err
+	}
+
+	return t.flushMessageStore(ctx)
+}
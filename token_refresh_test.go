@@ -0,0 +1,153 @@
+// Copyright 2018, Andrew C. Young
+// License: MIT
+
+package iot_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vaelen/iot"
+)
+
+// fakeClock lets a test control when the token refresh loop's wait expires without actually sleeping.
+type fakeClock struct {
+	mutex   sync.Mutex
+	fire    chan time.Time
+	advance bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{fire: make(chan time.Time, 1)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.advance {
+		c.advance = false
+		return c.fire
+	}
+	// Any wait after the first (e.g. inside the reconnect backoff loop) shouldn't fire on its own.
+	return make(chan time.Time)
+}
+
+func (c *fakeClock) Advance() {
+	c.mutex.Lock()
+	c.advance = true
+	c.mutex.Unlock()
+	c.fire <- time.Now()
+}
+
+func TestTokenRefreshReconnectsBeforeExpiration(t *testing.T) {
+	ctx := context.Background()
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return mockClient
+	}
+
+	clock := newFakeClock()
+	previousTimeAfter := iot.TimeAfter
+	iot.TimeAfter = clock.After
+	defer func() { iot.TimeAfter = previousTimeAfter }()
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(TestID, credentials)
+	options.TokenRefreshLeadTime = time.Minute
+
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	initialCredentialCalls, initialConnectedTo := mockClient.Snapshot()
+
+	clock.Advance()
+
+	deadline := time.Now().Add(time.Second)
+	var credentialCalls int
+	var connectedTo []string
+	for time.Now().Before(deadline) {
+		credentialCalls, connectedTo = mockClient.Snapshot()
+		if credentialCalls > initialCredentialCalls {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if credentialCalls <= initialCredentialCalls {
+		t.Fatal("CredentialsProvider wasn't called again after the token refresh fired")
+	}
+	if len(connectedTo) <= len(initialConnectedTo) {
+		t.Fatalf("Connect wasn't re-invoked after the token refresh fired: %v", connectedTo)
+	}
+}
+
+func TestTokenRefreshReattachesGatewayDevices(t *testing.T) {
+	ctx := context.Background()
+	var mockClient *iot.MockMQTTClient
+	iot.NewClient = func(t iot.Thing, o *iot.ThingOptions) iot.MQTTClient {
+		mockClient = iot.NewMockClient(t, o)
+		return mockClient
+	}
+
+	clock := newFakeClock()
+	previousTimeAfter := iot.TimeAfter
+	iot.TimeAfter = clock.After
+	defer func() { iot.TimeAfter = previousTimeAfter }()
+
+	credentials, err := iot.LoadCredentials(CertificatePath, PrivateKeyPath)
+	if err != nil {
+		t.Fatalf("Couldn't load credentials: %v", err)
+	}
+
+	options := iot.DefaultOptions(GatewayID, credentials)
+	options.TokenRefreshLeadTime = time.Minute
+
+	thing := iot.New(options)
+	if err := thing.Connect(ctx, "ssl://mqtt.example.com:443"); err != nil {
+		t.Fatalf("Couldn't connect. Error: %v", err)
+	}
+	defer thing.Disconnect(ctx)
+
+	if err := thing.AttachDevice(ctx, "attached-device", "attached-device-jwt"); err != nil {
+		t.Fatalf("Couldn't attach device: %v", err)
+	}
+
+	received := ""
+	if err := thing.SubscribeConfigAs(ctx, "attached-device", func(t iot.Thing, config []byte) {
+		received = string(config)
+	}); err != nil {
+		t.Fatalf("Couldn't subscribe to config as attached device: %v", err)
+	}
+
+	attachTopic := "/devices/attached-device/attach"
+
+	clock.Advance()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, connectedTo := mockClient.Snapshot(); len(connectedTo) > 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	l, ok := mockClient.Messages[attachTopic]
+	if !ok || len(l) != 2 {
+		t.Fatalf("Device wasn't re-attached after the token refresh fired. Attach messages: %v", l)
+	}
+
+	mockClient.Receive("/devices/attached-device/config", []byte("attached config"))
+	if received != "attached config" {
+		t.Fatal("Config subscription wasn't replayed after the token refresh fired")
+	}
+}